@@ -0,0 +1,68 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package harmonizecode contains utilities for harmonizing codes using FHIR
+// ConceptMaps.
+package harmonizecode
+
+// CodeHarmonizer harmonizes codes from a source code system into one or more
+// target code systems using FHIR ConceptMaps.
+type CodeHarmonizer interface {
+	// Harmonize maps sourceCode in sourceSystem to every target the ConceptMap
+	// named sourceName contains a mapping for.
+	Harmonize(sourceCode, sourceSystem, sourceName string) ([]HarmonizedCode, error)
+
+	// HarmonizeWithTarget is like Harmonize, but restricts the result to
+	// mappings whose target code system matches targetSystem. An empty
+	// targetSystem behaves like Harmonize.
+	HarmonizeWithTarget(sourceCode, sourceSystem, targetSystem, sourceName string) ([]HarmonizedCode, error)
+
+	// HarmonizeWithOptions is like HarmonizeWithTarget, but filters and orders
+	// the result by FHIR ConceptMap equivalence per opts, and populates the
+	// Equivalence field on every returned HarmonizedCode that comes from a
+	// ConceptMap mapping. Unmapped and unharmonized fallback codes carry no
+	// equivalence. An empty targetSystem behaves like Harmonize.
+	HarmonizeWithOptions(sourceCode, sourceSystem, targetSystem, sourceName string, opts HarmonizeOptions) ([]HarmonizedCode, error)
+
+	// HarmonizeReverse maps targetCode in targetSystem back to every source
+	// the ConceptMap named sourceName contains a mapping for, i.e. the
+	// opposite direction from Harmonize.
+	HarmonizeReverse(targetCode, targetSystem, sourceName string) ([]HarmonizedCode, error)
+
+	// HarmonizeReverseWithSource is like HarmonizeReverse, but restricts the
+	// result to mappings whose source code system matches sourceSystem. An
+	// empty sourceSystem behaves like HarmonizeReverse.
+	HarmonizeReverseWithSource(targetCode, targetSystem, sourceSystem, sourceName string) ([]HarmonizedCode, error)
+}
+
+// HarmonizedCode is a single code produced by harmonizing a source code
+// against a ConceptMap.
+type HarmonizedCode struct {
+	Code    string
+	System  string
+	Display string
+	Version string
+	// Equivalence is the FHIR ConceptMap equivalence of this mapping (see the
+	// Equivalence* constants). It is only populated by HarmonizeWithOptions;
+	// Harmonize and HarmonizeWithTarget always leave it empty.
+	Equivalence string
+}
+
+// CodeLookupKey identifies a single code harmonization lookup, for use as a
+// cache key.
+type CodeLookupKey struct {
+	Code         string
+	System       string
+	ConceptMapID string
+}
@@ -0,0 +1,63 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harmonizecode
+
+// Canonical FHIR ConceptMap equivalence values. Every HarmonizeWithOptions
+// implementation normalizes to these regardless of which FHIR version or
+// transport (a cached ConceptMap, a remote $translate call) produced the
+// result.
+const (
+	EquivalenceEqual       = "EQUAL"
+	EquivalenceEquivalent  = "EQUIVALENT"
+	EquivalenceWider       = "WIDER"
+	EquivalenceSubsumes    = "SUBSUMES"
+	EquivalenceNarrower    = "NARROWER"
+	EquivalenceSpecializes = "SPECIALIZES"
+	EquivalenceInexact     = "INEXACT"
+	EquivalenceRelatedTo   = "RELATEDTO"
+	EquivalenceUnmatched   = "UNMATCHED"
+	EquivalenceDisjoint    = "DISJOINT"
+)
+
+// equivalenceRank orders equivalence values from closest (highest) to
+// loosest (lowest) match, per the FHIR ConceptMapEquivalence value set
+// semantics: equal and equivalent are the strongest claims, followed by the
+// wider/narrower family, then the weakest non-failure claims.
+var equivalenceRank = map[string]int{
+	EquivalenceEqual:       9,
+	EquivalenceEquivalent:  8,
+	EquivalenceWider:       7,
+	EquivalenceSubsumes:    7,
+	EquivalenceNarrower:    6,
+	EquivalenceSpecializes: 6,
+	EquivalenceInexact:     5,
+	EquivalenceRelatedTo:   4,
+	EquivalenceUnmatched:   0,
+	EquivalenceDisjoint:    0,
+}
+
+// unrankedEquivalence is the rank used for codes with no (or an unrecognized)
+// equivalence, e.g. the unharmonized fallback codes Harmonize produces when
+// nothing matches. It sorts below every known equivalence.
+const unrankedEquivalence = -1
+
+// equivalenceRankOf returns equivalence's rank, or unrankedEquivalence if it
+// is empty or not a recognized equivalence value.
+func equivalenceRankOf(equivalence string) int {
+	if rank, ok := equivalenceRank[equivalence]; ok {
+		return rank
+	}
+	return unrankedEquivalence
+}
@@ -0,0 +1,152 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harmonizecode
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// cacheEntry is a single value stored in an ExpiringCache along with the time
+// at which it should be considered stale.
+type cacheEntry struct {
+	key    CodeLookupKey
+	value  []HarmonizedCode
+	expiry time.Time
+}
+
+// ExpiringCache is a thread-safe cache of harmonized codes that evicts
+// entries a fixed amount of time after they were written, via a periodic
+// cleanup sweep, and additionally bounds its size by evicting the least
+// recently used entry whenever a Put would otherwise exceed maxEntries.
+type ExpiringCache struct {
+	mu              sync.Mutex
+	ttl             time.Duration
+	cleanupInterval time.Duration
+	// maxEntries is the most entries the cache may hold at once; 0 means
+	// unbounded.
+	maxEntries int
+
+	// ll orders entries from most (front) to least (back) recently used. items
+	// indexes the same entries by key for O(1) lookup.
+	ll    *list.List
+	items map[CodeLookupKey]*list.Element
+}
+
+// NewCache creates an unbounded ExpiringCache whose entries expire
+// ttlSeconds after being written, with a background sweep every
+// cleanupIntervalSeconds that removes expired entries.
+func NewCache(ttlSeconds, cleanupIntervalSeconds int) *ExpiringCache {
+	return NewCacheWithOptions(ttlSeconds, cleanupIntervalSeconds, 0)
+}
+
+// NewCacheWithOptions is like NewCache, but also bounds the cache to
+// maxEntries, evicting the least recently used entry on Put once full. A
+// maxEntries of 0 means unbounded, same as NewCache.
+func NewCacheWithOptions(ttlSeconds, cleanupIntervalSeconds, maxEntries int) *ExpiringCache {
+	c := &ExpiringCache{
+		ttl:             time.Duration(ttlSeconds) * time.Second,
+		cleanupInterval: time.Duration(cleanupIntervalSeconds) * time.Second,
+		maxEntries:      maxEntries,
+		ll:              list.New(),
+		items:           make(map[CodeLookupKey]*list.Element),
+	}
+	go c.cleanupLoop()
+	return c
+}
+
+// Put stores value under key, resetting its TTL and marking it most recently
+// used. If the cache is full and key is not already present, the least
+// recently used entry is evicted first.
+func (c *ExpiringCache) Put(key CodeLookupKey, value []HarmonizedCode) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiry := time.Now().Add(c.ttl)
+	if el, ok := c.items[key]; ok {
+		el.Value.(*cacheEntry).value = value
+		el.Value.(*cacheEntry).expiry = expiry
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	if c.maxEntries > 0 && c.ll.Len() >= c.maxEntries {
+		c.evictOldest()
+	}
+	el := c.ll.PushFront(&cacheEntry{key: key, value: value, expiry: expiry})
+	c.items[key] = el
+}
+
+// Get returns the value stored under key, if present and not yet expired,
+// and marks it most recently used.
+func (c *ExpiringCache) Get(key CodeLookupKey) ([]HarmonizedCode, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expiry) {
+		c.removeElement(el)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return entry.value, true
+}
+
+// Len returns the number of entries currently in the cache, including any
+// that have expired but have not yet been swept.
+func (c *ExpiringCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// evictOldest removes the least recently used entry. c.mu must be held.
+func (c *ExpiringCache) evictOldest() {
+	oldest := c.ll.Back()
+	if oldest != nil {
+		c.removeElement(oldest)
+	}
+}
+
+// removeElement removes el from both the LRU list and the lookup map. c.mu
+// must be held.
+func (c *ExpiringCache) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*cacheEntry).key)
+}
+
+// cleanupLoop periodically removes expired entries. The loop never exits, so
+// it keeps running (and keeps the cache alive) for the life of the process.
+func (c *ExpiringCache) cleanupLoop() {
+	ticker := time.NewTicker(c.cleanupInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.mu.Lock()
+		now := time.Now()
+		for el := c.ll.Back(); el != nil; {
+			prev := el.Prev()
+			if now.After(el.Value.(*cacheEntry).expiry) {
+				c.removeElement(el)
+			}
+			el = prev
+		}
+		c.mu.Unlock()
+	}
+}
@@ -117,3 +117,95 @@ func TestConcurrentGoroutines(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestCacheEvictsLeastRecentlyUsedWhenFull(t *testing.T) {
+	cache := NewCacheWithOptions(60, 60, 2)
+	keyA := CodeLookupKey{Code: "a"}
+	keyB := CodeLookupKey{Code: "b"}
+	keyC := CodeLookupKey{Code: "c"}
+
+	cache.Put(keyA, []HarmonizedCode{{Code: "a"}})
+	cache.Put(keyB, []HarmonizedCode{{Code: "b"}})
+	cache.Put(keyC, []HarmonizedCode{{Code: "c"}})
+
+	if got := cache.Len(); got != 2 {
+		t.Fatalf("cache.Len() = %d, want 2", got)
+	}
+	if _, ok := cache.Get(keyA); ok {
+		t.Errorf("expected keyA to have been evicted as the least recently used entry")
+	}
+	if _, ok := cache.Get(keyB); !ok {
+		t.Errorf("expected keyB to still be cached")
+	}
+	if _, ok := cache.Get(keyC); !ok {
+		t.Errorf("expected keyC to still be cached")
+	}
+}
+
+func TestCacheGetPromotesToMostRecentlyUsed(t *testing.T) {
+	cache := NewCacheWithOptions(60, 60, 2)
+	keyA := CodeLookupKey{Code: "a"}
+	keyB := CodeLookupKey{Code: "b"}
+	keyC := CodeLookupKey{Code: "c"}
+
+	cache.Put(keyA, []HarmonizedCode{{Code: "a"}})
+	cache.Put(keyB, []HarmonizedCode{{Code: "b"}})
+
+	// Touching keyA makes keyB the least recently used entry.
+	if _, ok := cache.Get(keyA); !ok {
+		t.Fatalf("expected keyA to be cached")
+	}
+	cache.Put(keyC, []HarmonizedCode{{Code: "c"}})
+
+	if _, ok := cache.Get(keyB); ok {
+		t.Errorf("expected keyB to have been evicted after keyA was promoted")
+	}
+	if _, ok := cache.Get(keyA); !ok {
+		t.Errorf("expected keyA to still be cached")
+	}
+	if _, ok := cache.Get(keyC); !ok {
+		t.Errorf("expected keyC to still be cached")
+	}
+}
+
+func TestCacheTTLExpiryFreesSpaceForLRU(t *testing.T) {
+	cache := NewCacheWithOptions(1, 60, 2)
+	keyA := CodeLookupKey{Code: "a"}
+	keyB := CodeLookupKey{Code: "b"}
+	keyC := CodeLookupKey{Code: "c"}
+
+	cache.Put(keyA, []HarmonizedCode{{Code: "a"}})
+	time.Sleep(2 * time.Second)
+
+	// keyA has expired but the cleanup sweep (every 60s) has not run yet, so
+	// Put still sees a full cache and must fall back to evicting it as the
+	// least recently used entry rather than leaving it stranded.
+	cache.Put(keyB, []HarmonizedCode{{Code: "b"}})
+	cache.Put(keyC, []HarmonizedCode{{Code: "c"}})
+
+	if _, ok := cache.Get(keyA); ok {
+		t.Errorf("expected expired keyA to be gone")
+	}
+	if _, ok := cache.Get(keyB); !ok {
+		t.Errorf("expected keyB to still be cached")
+	}
+	if _, ok := cache.Get(keyC); !ok {
+		t.Errorf("expected keyC to still be cached")
+	}
+}
+
+func BenchmarkExpiringCache_PutUnbounded(b *testing.B) {
+	cache := NewCacheWithOptions(60, 60, 0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.Put(CodeLookupKey{Code: string(rune(i % 1000))}, []HarmonizedCode{})
+	}
+}
+
+func BenchmarkExpiringCache_PutBoundedLRU(b *testing.B) {
+	cache := NewCacheWithOptions(60, 60, 1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.Put(CodeLookupKey{Code: string(rune(i % 1000))}, []HarmonizedCode{})
+	}
+}
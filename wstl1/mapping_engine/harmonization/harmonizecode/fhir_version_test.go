@@ -0,0 +1,441 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harmonizecode
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
+)
+
+func buildTestVersionedHarmonizer(version FHIRVersion, rawMaps []json.RawMessage) (CodeHarmonizer, error) {
+	local := NewLocalCodeHarmonizer()
+	for _, m := range rawMaps {
+		if err := local.CacheVersion(m, version); err != nil {
+			return nil, fmt.Errorf("CacheVersion failed with error: %v", err)
+		}
+	}
+	return local, nil
+}
+
+func TestHarmonizeR4(t *testing.T) {
+	tests := []struct {
+		name           string
+		rawConceptMap  json.RawMessage
+		sourceCode     string
+		sourceSystem   string
+		sourceName     string
+		expectedOutput []HarmonizedCode
+	}{
+		{
+			name: "single target code via sourceUri/targetUri",
+			rawConceptMap: json.RawMessage(`{
+				"group":[
+					{
+						"element":[
+							{
+								"code":"abc",
+								"target":[
+									{
+										"code":"def",
+										"display": "DEF",
+										"equivalence": "EQUIVALENT"
+									}
+								]
+							}
+						],
+						"sourceUri": "foo",
+						"targetUri": "xyz"
+					}
+				],
+				"id": "foo",
+				"version": "bar",
+				"resourceType":"ConceptMap"
+			}`),
+			sourceCode:   "abc",
+			sourceSystem: "foo",
+			sourceName:   "foo",
+			expectedOutput: []HarmonizedCode{
+				HarmonizedCode{
+					Code:    "def",
+					System:  "xyz",
+					Display: "DEF",
+					Version: "bar",
+				},
+			},
+		},
+		{
+			name: "single target code via sourceCanonical/targetCanonical",
+			rawConceptMap: json.RawMessage(`{
+				"group":[
+					{
+						"element":[
+							{
+								"code":"abc",
+								"target":[
+									{
+										"code":"def",
+										"equivalence": "EQUIVALENT"
+									}
+								]
+							}
+						],
+						"sourceCanonical": "foo",
+						"targetCanonical": "xyz"
+					}
+				],
+				"id": "foo",
+				"version": "bar",
+				"resourceType":"ConceptMap"
+			}`),
+			sourceCode:   "abc",
+			sourceSystem: "foo",
+			sourceName:   "foo",
+			expectedOutput: []HarmonizedCode{
+				HarmonizedCode{
+					Code:    "def",
+					System:  "xyz",
+					Version: "bar",
+				},
+			},
+		},
+		{
+			name: "no matches found falls back to unharmonized",
+			rawConceptMap: json.RawMessage(`{
+				"group":[
+					{
+						"element":[
+							{
+								"code": "abc",
+								"target":[
+									{
+										"code": "def",
+										"equivalence": "EQUIVALENT"
+									}
+								]
+							}
+						],
+						"sourceUri": "foo",
+						"targetUri": "xyz"
+					}
+				],
+				"id": "foo",
+				"version": "bar",
+				"resourceType": "ConceptMap"
+			}`),
+			sourceCode:   "unmatched",
+			sourceSystem: "foo",
+			sourceName:   "foo",
+			expectedOutput: []HarmonizedCode{
+				HarmonizedCode{
+					Code:    "unmatched",
+					System:  "foo-unharmonized",
+					Version: "bar",
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			harmonizer, err := buildTestVersionedHarmonizer(FHIRVersionR4, []json.RawMessage{test.rawConceptMap})
+			if err != nil {
+				t.Fatalf("buildTestVersionedHarmonizer returned unexpected error: %v", err)
+			}
+
+			actualOutput, err := harmonizer.Harmonize(test.sourceCode, test.sourceSystem, test.sourceName)
+			if err != nil {
+				t.Fatalf("Harmonize(%s, %s, %s) returned unexpected error: %v", test.sourceCode, test.sourceSystem, test.sourceName, err)
+			}
+
+			if diff := cmp.Diff(test.expectedOutput, actualOutput); diff != "" {
+				t.Errorf("Harmonize(%s, %s, %s) => diff -%v +%v\n%s", test.sourceCode, test.sourceSystem, test.sourceName, test.expectedOutput, actualOutput, diff)
+			}
+		})
+	}
+}
+
+func TestHarmonizeWithTargetR4(t *testing.T) {
+	testConceptMap := json.RawMessage(`{
+				"group":[
+					{
+						"element":[
+							{
+								"code": "abc",
+								"target":[
+									{
+										"code": "def1",
+										"equivalence": "EQUIVALENT"
+									}
+								]
+							}
+						],
+						"sourceUri": "s1",
+						"targetUri": "t1"
+					},
+					{
+						"element":[
+							{
+								"code": "abc",
+								"target":[
+									{
+										"code": "def2",
+										"equivalence": "EQUIVALENT"
+									}
+								]
+							}
+						],
+						"sourceUri": "s2",
+						"targetUri": "t2"
+					}
+				],
+				"id": "foo",
+				"version": "bar",
+				"resourceType":"ConceptMap"
+			}`)
+	tests := []struct {
+		name           string
+		sourceCode     string
+		sourceSystem   string
+		targetSystem   string
+		sourceName     string
+		expectedOutput []HarmonizedCode
+	}{
+		{
+			name:         "match source and target",
+			sourceCode:   "abc",
+			sourceSystem: "s1",
+			targetSystem: "t1",
+			sourceName:   "foo",
+			expectedOutput: []HarmonizedCode{
+				HarmonizedCode{Code: "def1", System: "t1", Version: "bar"},
+			},
+		},
+		{
+			name:         "match source and mismatch target",
+			sourceCode:   "abc",
+			sourceSystem: "s1",
+			targetSystem: "t2",
+			sourceName:   "foo",
+			expectedOutput: []HarmonizedCode{
+				HarmonizedCode{Code: "abc", System: "foo-unharmonized", Version: "bar"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			harmonizer, err := buildTestVersionedHarmonizer(FHIRVersionR4, []json.RawMessage{testConceptMap})
+			if err != nil {
+				t.Fatalf("buildTestVersionedHarmonizer returned unexpected error: %v", err)
+			}
+
+			actualOutput, err := harmonizer.HarmonizeWithTarget(test.sourceCode, test.sourceSystem, test.targetSystem, test.sourceName)
+			if err != nil {
+				t.Fatalf("HarmonizeWithTarget(%s, %s, %s, %s) returned unexpected error: %v", test.sourceCode, test.sourceSystem, test.targetSystem, test.sourceName, err)
+			}
+
+			if diff := cmp.Diff(test.expectedOutput, actualOutput); diff != "" {
+				t.Errorf("HarmonizeWithTarget(%s, %s, %s, %s) => diff -%v +%v\n%s", test.sourceCode, test.sourceSystem, test.targetSystem, test.sourceName, test.expectedOutput, actualOutput, diff)
+			}
+		})
+	}
+}
+
+func TestHarmonizeR5(t *testing.T) {
+	tests := []struct {
+		name           string
+		rawConceptMap  json.RawMessage
+		sourceCode     string
+		sourceSystem   string
+		sourceName     string
+		expectedOutput []HarmonizedCode
+	}{
+		{
+			name: "equivalent relationship",
+			rawConceptMap: json.RawMessage(`{
+				"group":[
+					{
+						"element":[
+							{
+								"code":"abc",
+								"target":[
+									{
+										"code":"def",
+										"display": "DEF",
+										"relationship": "equivalent"
+									}
+								]
+							}
+						],
+						"sourceUri": "foo",
+						"targetUri": "xyz"
+					}
+				],
+				"id": "foo",
+				"version": "bar",
+				"resourceType":"ConceptMap"
+			}`),
+			sourceCode:   "abc",
+			sourceSystem: "foo",
+			sourceName:   "foo",
+			expectedOutput: []HarmonizedCode{
+				HarmonizedCode{
+					Code:    "def",
+					System:  "xyz",
+					Display: "DEF",
+					Version: "bar",
+				},
+			},
+		},
+		{
+			name: "multiple targets with mixed relationships, returned in ConceptMap order",
+			rawConceptMap: json.RawMessage(`{
+				"group":[
+					{
+						"element":[
+							{
+								"code":"abc",
+								"target":[
+									{
+										"code":"narrow",
+										"relationship": "source-is-narrower-than-target"
+									},
+									{
+										"code":"wide",
+										"relationship": "source-is-broader-than-target"
+									}
+								]
+							}
+						],
+						"sourceUri": "foo",
+						"targetUri": "xyz"
+					}
+				],
+				"id": "foo",
+				"version": "bar",
+				"resourceType":"ConceptMap"
+			}`),
+			sourceCode:   "abc",
+			sourceSystem: "foo",
+			sourceName:   "foo",
+			expectedOutput: []HarmonizedCode{
+				HarmonizedCode{Code: "narrow", System: "xyz", Version: "bar"},
+				HarmonizedCode{Code: "wide", System: "xyz", Version: "bar"},
+			},
+		},
+		{
+			name: "no matches found falls back to unharmonized",
+			rawConceptMap: json.RawMessage(`{
+				"group":[
+					{
+						"element":[
+							{
+								"code": "abc",
+								"target":[
+									{
+										"code": "def",
+										"relationship": "equivalent"
+									}
+								]
+							}
+						],
+						"sourceUri": "foo",
+						"targetUri": "xyz"
+					}
+				],
+				"id": "foo",
+				"version": "bar",
+				"resourceType": "ConceptMap"
+			}`),
+			sourceCode:   "unmatched",
+			sourceSystem: "foo",
+			sourceName:   "foo",
+			expectedOutput: []HarmonizedCode{
+				HarmonizedCode{
+					Code:    "unmatched",
+					System:  "foo-unharmonized",
+					Version: "bar",
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			harmonizer, err := buildTestVersionedHarmonizer(FHIRVersionR5, []json.RawMessage{test.rawConceptMap})
+			if err != nil {
+				t.Fatalf("buildTestVersionedHarmonizer returned unexpected error: %v", err)
+			}
+
+			actualOutput, err := harmonizer.Harmonize(test.sourceCode, test.sourceSystem, test.sourceName)
+			if err != nil {
+				t.Fatalf("Harmonize(%s, %s, %s) returned unexpected error: %v", test.sourceCode, test.sourceSystem, test.sourceName, err)
+			}
+
+			if diff := cmp.Diff(test.expectedOutput, actualOutput); diff != "" {
+				t.Errorf("Harmonize(%s, %s, %s) => diff -%v +%v\n%s", test.sourceCode, test.sourceSystem, test.sourceName, test.expectedOutput, actualOutput, diff)
+			}
+		})
+	}
+}
+
+func TestHarmonizeR5_Errors(t *testing.T) {
+	tests := []struct {
+		name          string
+		rawConceptMap json.RawMessage
+	}{
+		{
+			name: "unsupported relationship value",
+			rawConceptMap: json.RawMessage(`{
+				"group":[
+					{
+						"element":[
+							{
+								"code": "abc",
+								"target":[
+									{
+										"code": "def",
+										"relationship": "some-other-relationship"
+									}
+								]
+							}
+						],
+						"sourceUri": "foo",
+						"targetUri": "xyz"
+					}
+				],
+				"id": "foo",
+				"version": "bar",
+				"resourceType": "ConceptMap"
+			}`),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := buildTestVersionedHarmonizer(FHIRVersionR5, []json.RawMessage{test.rawConceptMap})
+			if err == nil {
+				t.Fatalf("Parsing concept map in test %s expected error but received no errors.", test.name)
+			}
+		})
+	}
+}
+
+func TestCacheVersion_UnsupportedVersion(t *testing.T) {
+	local := NewLocalCodeHarmonizer()
+	raw := json.RawMessage(`{"resourceType":"ConceptMap","id":"foo","version":"bar","group":[]}`)
+	if err := local.CacheVersion(raw, FHIRVersion(99)); err == nil {
+		t.Fatalf("CacheVersion with an unsupported FHIRVersion expected an error but received none.")
+	}
+}
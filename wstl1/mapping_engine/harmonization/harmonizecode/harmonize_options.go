@@ -0,0 +1,80 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harmonizecode
+
+import "sort"
+
+// SortOrder controls how HarmonizeWithOptions orders its results relative to
+// FHIR ConceptMap equivalence rank.
+type SortOrder int
+
+const (
+	// SortNone leaves results in the order Harmonize and HarmonizeWithTarget
+	// would return them.
+	SortNone SortOrder = iota
+	// SortBestEquivalenceFirst orders results from closest to loosest match.
+	SortBestEquivalenceFirst
+	// SortWorstEquivalenceFirst orders results from loosest to closest match.
+	SortWorstEquivalenceFirst
+)
+
+// HarmonizeOptions filters and orders the results of HarmonizeWithOptions by
+// FHIR ConceptMap equivalence.
+type HarmonizeOptions struct {
+	// AllowedEquivalence restricts results to these equivalence values. A nil
+	// or empty set allows every equivalence.
+	AllowedEquivalence map[string]bool
+	// MinEquivalenceRank drops any result ranked below it; see equivalenceRank
+	// for the canonical ranking. Unranked results, e.g. the unharmonized
+	// fallback codes Harmonize and HarmonizeWithTarget return for a no-match
+	// lookup, are never dropped by this filter: they carry no equivalence
+	// claim to rank, so the zero-value HarmonizeOptions{} still returns them.
+	MinEquivalenceRank int
+	// DropUnmapped drops EquivalenceUnmatched and EquivalenceDisjoint results,
+	// which signal the absence of a real mapping rather than a match.
+	DropUnmapped bool
+	// Sort controls the order of the returned results.
+	Sort SortOrder
+}
+
+// applyHarmonizeOptions filters and sorts codes per opts, without mutating
+// codes.
+func applyHarmonizeOptions(codes []HarmonizedCode, opts HarmonizeOptions) []HarmonizedCode {
+	var out []HarmonizedCode
+	for _, c := range codes {
+		if opts.DropUnmapped && (c.Equivalence == EquivalenceUnmatched || c.Equivalence == EquivalenceDisjoint) {
+			continue
+		}
+		if len(opts.AllowedEquivalence) > 0 && !opts.AllowedEquivalence[c.Equivalence] {
+			continue
+		}
+		if rank := equivalenceRankOf(c.Equivalence); rank != unrankedEquivalence && rank < opts.MinEquivalenceRank {
+			continue
+		}
+		out = append(out, c)
+	}
+
+	switch opts.Sort {
+	case SortBestEquivalenceFirst:
+		sort.SliceStable(out, func(i, j int) bool {
+			return equivalenceRankOf(out[i].Equivalence) > equivalenceRankOf(out[j].Equivalence)
+		})
+	case SortWorstEquivalenceFirst:
+		sort.SliceStable(out, func(i, j int) bool {
+			return equivalenceRankOf(out[i].Equivalence) < equivalenceRankOf(out[j].Equivalence)
+		})
+	}
+	return out
+}
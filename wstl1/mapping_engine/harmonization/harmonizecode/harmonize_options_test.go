@@ -0,0 +1,222 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harmonizecode
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
+)
+
+func TestLocalHarmonizeWithOptions(t *testing.T) {
+	rawConceptMap := json.RawMessage(`{
+		"group":[
+			{
+				"element":[
+					{
+						"code": "abc",
+						"target":[
+							{"code": "equal-match", "equivalence": "EQUAL"},
+							{"code": "equivalent-match", "equivalence": "EQUIVALENT"},
+							{"code": "wider-match", "equivalence": "WIDER"},
+							{"code": "narrower-match", "equivalence": "NARROWER"},
+							{"code": "inexact-match", "equivalence": "INEXACT"},
+							{"code": "related-match", "equivalence": "RELATEDTO"},
+							{"code": "unmatched-match", "equivalence": "UNMATCHED"},
+							{"code": "disjoint-match", "equivalence": "DISJOINT"}
+						]
+					}
+				],
+				"target": "xyz"
+			}
+		],
+		"id": "foo",
+		"version": "bar",
+		"resourceType":"ConceptMap"
+	}`)
+
+	tests := []struct {
+		name           string
+		opts           HarmonizeOptions
+		expectedOutput []HarmonizedCode
+	}{
+		{
+			name: "no filtering, sorted best first",
+			opts: HarmonizeOptions{Sort: SortBestEquivalenceFirst},
+			expectedOutput: []HarmonizedCode{
+				{Code: "equal-match", System: "xyz", Version: "bar", Equivalence: "EQUAL"},
+				{Code: "equivalent-match", System: "xyz", Version: "bar", Equivalence: "EQUIVALENT"},
+				{Code: "wider-match", System: "xyz", Version: "bar", Equivalence: "WIDER"},
+				{Code: "narrower-match", System: "xyz", Version: "bar", Equivalence: "NARROWER"},
+				{Code: "inexact-match", System: "xyz", Version: "bar", Equivalence: "INEXACT"},
+				{Code: "related-match", System: "xyz", Version: "bar", Equivalence: "RELATEDTO"},
+				{Code: "unmatched-match", System: "xyz", Version: "bar", Equivalence: "UNMATCHED"},
+				{Code: "disjoint-match", System: "xyz", Version: "bar", Equivalence: "DISJOINT"},
+			},
+		},
+		{
+			name: "drop unmapped",
+			opts: HarmonizeOptions{DropUnmapped: true, Sort: SortBestEquivalenceFirst},
+			expectedOutput: []HarmonizedCode{
+				{Code: "equal-match", System: "xyz", Version: "bar", Equivalence: "EQUAL"},
+				{Code: "equivalent-match", System: "xyz", Version: "bar", Equivalence: "EQUIVALENT"},
+				{Code: "wider-match", System: "xyz", Version: "bar", Equivalence: "WIDER"},
+				{Code: "narrower-match", System: "xyz", Version: "bar", Equivalence: "NARROWER"},
+				{Code: "inexact-match", System: "xyz", Version: "bar", Equivalence: "INEXACT"},
+				{Code: "related-match", System: "xyz", Version: "bar", Equivalence: "RELATEDTO"},
+			},
+		},
+		{
+			name: "minimum rank keeps only equal and equivalent",
+			opts: HarmonizeOptions{MinEquivalenceRank: equivalenceRank[EquivalenceEquivalent], Sort: SortBestEquivalenceFirst},
+			expectedOutput: []HarmonizedCode{
+				{Code: "equal-match", System: "xyz", Version: "bar", Equivalence: "EQUAL"},
+				{Code: "equivalent-match", System: "xyz", Version: "bar", Equivalence: "EQUIVALENT"},
+			},
+		},
+		{
+			name: "allowed equivalence set restricts to listed values",
+			opts: HarmonizeOptions{AllowedEquivalence: map[string]bool{EquivalenceWider: true, EquivalenceNarrower: true}, Sort: SortBestEquivalenceFirst},
+			expectedOutput: []HarmonizedCode{
+				{Code: "wider-match", System: "xyz", Version: "bar", Equivalence: "WIDER"},
+				{Code: "narrower-match", System: "xyz", Version: "bar", Equivalence: "NARROWER"},
+			},
+		},
+		{
+			name: "sort worst equivalence first",
+			opts: HarmonizeOptions{DropUnmapped: true, Sort: SortWorstEquivalenceFirst},
+			expectedOutput: []HarmonizedCode{
+				{Code: "related-match", System: "xyz", Version: "bar", Equivalence: "RELATEDTO"},
+				{Code: "inexact-match", System: "xyz", Version: "bar", Equivalence: "INEXACT"},
+				{Code: "narrower-match", System: "xyz", Version: "bar", Equivalence: "NARROWER"},
+				{Code: "wider-match", System: "xyz", Version: "bar", Equivalence: "WIDER"},
+				{Code: "equivalent-match", System: "xyz", Version: "bar", Equivalence: "EQUIVALENT"},
+				{Code: "equal-match", System: "xyz", Version: "bar", Equivalence: "EQUAL"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			harmonizer, err := buildTestLocalHarmonizer([]json.RawMessage{rawConceptMap})
+			if err != nil {
+				t.Fatalf("buildTestLocalHarmonizer returned unexpected error: %v", err)
+			}
+
+			actualOutput, err := harmonizer.HarmonizeWithOptions("abc", "foo", "", "foo", test.opts)
+			if err != nil {
+				t.Fatalf("HarmonizeWithOptions returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(test.expectedOutput, actualOutput); diff != "" {
+				t.Errorf("HarmonizeWithOptions() => diff (-want +got)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLocalHarmonize_DoesNotPopulateEquivalence(t *testing.T) {
+	rawConceptMap := json.RawMessage(`{
+		"group":[
+			{
+				"element":[
+					{"code": "abc", "target":[{"code": "def", "equivalence": "EQUIVALENT"}]}
+				],
+				"target": "xyz"
+			}
+		],
+		"id": "foo",
+		"version": "bar",
+		"resourceType":"ConceptMap"
+	}`)
+	harmonizer, err := buildTestLocalHarmonizer([]json.RawMessage{rawConceptMap})
+	if err != nil {
+		t.Fatalf("buildTestLocalHarmonizer returned unexpected error: %v", err)
+	}
+
+	got, err := harmonizer.Harmonize("abc", "foo", "foo")
+	if err != nil {
+		t.Fatalf("Harmonize returned unexpected error: %v", err)
+	}
+	want := []HarmonizedCode{{Code: "def", System: "xyz", Version: "bar"}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Harmonize() => diff (-want +got)\n%s", diff)
+	}
+}
+
+func TestLocalHarmonizeWithOptions_NoMatchKeepsUnharmonizedFallback(t *testing.T) {
+	rawConceptMap := json.RawMessage(`{
+		"group":[
+			{
+				"element":[
+					{"code": "abc", "target":[{"code": "def", "equivalence": "EQUIVALENT"}]}
+				],
+				"target": "xyz"
+			}
+		],
+		"id": "foo",
+		"version": "bar",
+		"resourceType":"ConceptMap"
+	}`)
+	harmonizer, err := buildTestLocalHarmonizer([]json.RawMessage{rawConceptMap})
+	if err != nil {
+		t.Fatalf("buildTestLocalHarmonizer returned unexpected error: %v", err)
+	}
+
+	// "zzz" matches no element, so Harmonize would return the
+	// "foo-unharmonized" fallback. A zero-value HarmonizeOptions should not
+	// filter that fallback out just because it carries no equivalence rank.
+	got, err := harmonizer.HarmonizeWithOptions("zzz", "foo", "", "foo", HarmonizeOptions{})
+	if err != nil {
+		t.Fatalf("HarmonizeWithOptions returned unexpected error: %v", err)
+	}
+	want := []HarmonizedCode{{Code: "zzz", System: "foo-unharmonized", Version: "bar"}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("HarmonizeWithOptions() => diff (-want +got)\n%s", diff)
+	}
+}
+
+func TestRemoteHarmonizeWithOptions(t *testing.T) {
+	const body = `{
+		"resourceType": "Parameters",
+		"parameter": [
+			{"name": "match", "part": [
+				{"name": "equivalence", "valueCode": "equivalent"},
+				{"name": "concept", "valueCoding": {"system": "xyz1", "code": "def1"}}
+			]},
+			{"name": "match", "part": [
+				{"name": "equivalence", "valueCode": "inexact"},
+				{"name": "concept", "valueCoding": {"system": "xyz2", "code": "def2"}}
+			]}
+		]
+	}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	harmonizer := NewRemoteCodeHarmonizer(server.URL)
+	got, err := harmonizer.HarmonizeWithOptions("abc", "foo", "", "map-id", HarmonizeOptions{
+		MinEquivalenceRank: equivalenceRank[EquivalenceEquivalent],
+	})
+	if err != nil {
+		t.Fatalf("HarmonizeWithOptions returned unexpected error: %v", err)
+	}
+	want := []HarmonizedCode{{Code: "def1", System: "xyz1", Equivalence: "EQUIVALENT"}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("HarmonizeWithOptions() => diff (-want +got)\n%s", diff)
+	}
+}
@@ -0,0 +1,609 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harmonizecode
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Unmapped modes understood by conceptMapTarget resolution, per the FHIR
+// ConceptMap.group.unmapped.mode value set.
+const (
+	unmappedModeProvided = "provided"
+	unmappedModeFixed    = "fixed"
+)
+
+// conceptMapTarget is a single normalized target of a ConceptMap element,
+// i.e. the code a source code is mapped to along with how confidently it
+// maps.
+type conceptMapTarget struct {
+	code        string
+	display     string
+	equivalence string
+}
+
+// conceptMapElement is a single source code and the targets it maps to
+// within a group.
+type conceptMapElement struct {
+	code    string
+	targets []conceptMapTarget
+}
+
+// conceptMapUnmapped describes what to do with a group's elements that have
+// no match.
+type conceptMapUnmapped struct {
+	mode    string
+	code    string
+	display string
+}
+
+// conceptMapGroup is a single source system -> target system mapping group.
+type conceptMapGroup struct {
+	source   string
+	target   string
+	elements []conceptMapElement
+	unmapped *conceptMapUnmapped
+}
+
+// conceptMap is the internal, FHIR-version-agnostic representation of a
+// ConceptMap that all unmarshalers normalize to.
+type conceptMap struct {
+	id      string
+	version string
+	groups  []conceptMapGroup
+
+	// reverseIndex maps a target code back to every group that produces it,
+	// so HarmonizeReverse does not have to scan every element of every group.
+	// It is rebuilt whenever groups changes.
+	reverseIndex map[reverseIndexKey][]reverseMatch
+}
+
+// reverseIndexKey identifies all the reverse mappings for a single target
+// code within a single cached ConceptMap.
+type reverseIndexKey struct {
+	code         string
+	system       string
+	conceptMapID string
+}
+
+// reverseMatch is a single source code a target code reverse-maps to.
+type reverseMatch struct {
+	groupIdx     int
+	sourceCode   string
+	sourceSystem string
+	equivalence  string
+}
+
+// buildReverseIndex computes cm's reverseIndex from its current groups.
+func buildReverseIndex(cm *conceptMap) map[reverseIndexKey][]reverseMatch {
+	idx := make(map[reverseIndexKey][]reverseMatch)
+	for gi, g := range cm.groups {
+		groupTarget := g.target
+		if groupTarget == "" {
+			groupTarget = cm.id
+		}
+		groupSource := g.source
+		if groupSource == "" {
+			groupSource = cm.id
+		}
+		for _, e := range g.elements {
+			for _, t := range e.targets {
+				key := reverseIndexKey{code: t.code, system: groupTarget, conceptMapID: cm.id}
+				idx[key] = append(idx[key], reverseMatch{
+					groupIdx:     gi,
+					sourceCode:   e.code,
+					sourceSystem: groupSource,
+					equivalence:  t.equivalence,
+				})
+			}
+		}
+	}
+	return idx
+}
+
+// LocalCodeHarmonizer is a CodeHarmonizer backed by ConceptMaps that have
+// been loaded ahead of time via Cache.
+type LocalCodeHarmonizer struct {
+	maps map[string]*conceptMap
+}
+
+// NewLocalCodeHarmonizer creates an empty LocalCodeHarmonizer. Call Cache or
+// CacheVersion to populate it with ConceptMaps before harmonizing.
+func NewLocalCodeHarmonizer() *LocalCodeHarmonizer {
+	return &LocalCodeHarmonizer{maps: make(map[string]*conceptMap)}
+}
+
+// FHIRVersion identifies which FHIR release a ConceptMap resource conforms
+// to, since the shape of the source/target system fields and the target
+// equivalence value set both vary by version.
+type FHIRVersion int
+
+const (
+	// FHIRVersionR3 is the FHIR STU3 release.
+	FHIRVersionR3 FHIRVersion = iota
+	// FHIRVersionR4 is the FHIR R4 release.
+	FHIRVersionR4
+	// FHIRVersionR5 is the FHIR R5 release.
+	FHIRVersionR5
+)
+
+// CacheVersion unmarshals raw as a ConceptMap conforming to the given FHIR
+// version and caches it, same as Cache.
+func (l *LocalCodeHarmonizer) CacheVersion(raw json.RawMessage, version FHIRVersion) error {
+	var cm *conceptMap
+	var err error
+	switch version {
+	case FHIRVersionR3:
+		cm, err = unmarshalR3ConceptMap(raw)
+	case FHIRVersionR4:
+		cm, err = unmarshalR4ConceptMap(raw)
+	case FHIRVersionR5:
+		cm, err = unmarshalR5ConceptMap(raw)
+	default:
+		return fmt.Errorf("unsupported FHIR version: %v", version)
+	}
+	if err != nil {
+		return err
+	}
+	return l.Cache(cm)
+}
+
+// Cache adds cm to the harmonizer, merging its groups into any ConceptMap
+// already cached under the same ID.
+func (l *LocalCodeHarmonizer) Cache(cm *conceptMap) error {
+	if cm == nil {
+		return fmt.Errorf("cannot cache a nil ConceptMap")
+	}
+	if existing, ok := l.maps[cm.id]; ok {
+		existing.groups = append(existing.groups, cm.groups...)
+		existing.version = cm.version
+		existing.reverseIndex = buildReverseIndex(existing)
+		return nil
+	}
+	cm.reverseIndex = buildReverseIndex(cm)
+	l.maps[cm.id] = cm
+	return nil
+}
+
+// Harmonize implements CodeHarmonizer.
+func (l *LocalCodeHarmonizer) Harmonize(sourceCode, sourceSystem, sourceName string) ([]HarmonizedCode, error) {
+	return l.HarmonizeWithTarget(sourceCode, sourceSystem, "", sourceName)
+}
+
+// HarmonizeWithTarget implements CodeHarmonizer.
+func (l *LocalCodeHarmonizer) HarmonizeWithTarget(sourceCode, sourceSystem, targetSystem, sourceName string) ([]HarmonizedCode, error) {
+	codes, err := l.lookup(sourceCode, sourceSystem, targetSystem, sourceName)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]HarmonizedCode, len(codes))
+	for i, c := range codes {
+		c.Equivalence = ""
+		out[i] = c
+	}
+	return out, nil
+}
+
+// HarmonizeWithOptions implements CodeHarmonizer.
+func (l *LocalCodeHarmonizer) HarmonizeWithOptions(sourceCode, sourceSystem, targetSystem, sourceName string, opts HarmonizeOptions) ([]HarmonizedCode, error) {
+	codes, err := l.lookup(sourceCode, sourceSystem, targetSystem, sourceName)
+	if err != nil {
+		return nil, err
+	}
+	return applyHarmonizeOptions(codes, opts), nil
+}
+
+// lookup matches sourceCode against the cached ConceptMap named sourceName,
+// same as HarmonizeWithTarget, but also populates Equivalence on every
+// matched HarmonizedCode.
+func (l *LocalCodeHarmonizer) lookup(sourceCode, sourceSystem, targetSystem, sourceName string) ([]HarmonizedCode, error) {
+	cm, ok := l.maps[sourceName]
+	if !ok {
+		return nil, fmt.Errorf("no ConceptMap cached with name %q", sourceName)
+	}
+
+	var out []HarmonizedCode
+	for _, g := range cm.groups {
+		groupSource := g.source
+		if groupSource == "" {
+			groupSource = cm.id
+		}
+		if groupSource != sourceSystem {
+			continue
+		}
+		groupTarget := g.target
+		if groupTarget == "" {
+			groupTarget = cm.id
+		}
+		if targetSystem != "" && groupTarget != targetSystem {
+			continue
+		}
+
+		matched := false
+		for _, e := range g.elements {
+			if e.code != sourceCode {
+				continue
+			}
+			matched = true
+			for _, t := range e.targets {
+				out = append(out, HarmonizedCode{
+					Code:        t.code,
+					Display:     t.display,
+					System:      groupTarget,
+					Version:     cm.version,
+					Equivalence: strings.ToUpper(t.equivalence),
+				})
+			}
+		}
+		if !matched && g.unmapped != nil {
+			out = append(out, unmappedHarmonizedCode(g, sourceCode, groupTarget, cm.version))
+		}
+	}
+
+	if len(out) == 0 {
+		out = append(out, HarmonizedCode{
+			Code:    sourceCode,
+			System:  sourceName + "-unharmonized",
+			Version: cm.version,
+		})
+	}
+	return out, nil
+}
+
+// unmappedHarmonizedCode builds the fallback HarmonizedCode for a group whose
+// unmapped mode fired, per the FHIR ConceptMap.group.unmapped semantics.
+// target is g.target, defaulted to the ConceptMap id per the same rule lookup
+// and buildReverseIndex apply.
+func unmappedHarmonizedCode(g conceptMapGroup, sourceCode, target, version string) HarmonizedCode {
+	switch g.unmapped.mode {
+	case unmappedModeProvided:
+		return HarmonizedCode{Code: sourceCode, Display: sourceCode, System: target, Version: version}
+	case unmappedModeFixed:
+		return HarmonizedCode{Code: g.unmapped.code, Display: g.unmapped.display, System: target, Version: version}
+	default:
+		return HarmonizedCode{Code: sourceCode, System: target, Version: version}
+	}
+}
+
+// HarmonizeReverse implements CodeHarmonizer.
+func (l *LocalCodeHarmonizer) HarmonizeReverse(targetCode, targetSystem, sourceName string) ([]HarmonizedCode, error) {
+	return l.HarmonizeReverseWithSource(targetCode, targetSystem, "", sourceName)
+}
+
+// HarmonizeReverseWithSource implements CodeHarmonizer.
+func (l *LocalCodeHarmonizer) HarmonizeReverseWithSource(targetCode, targetSystem, sourceSystem, sourceName string) ([]HarmonizedCode, error) {
+	cm, ok := l.maps[sourceName]
+	if !ok {
+		return nil, fmt.Errorf("no ConceptMap cached with name %q", sourceName)
+	}
+
+	matchedGroups := make(map[int]bool)
+	var out []HarmonizedCode
+	for _, m := range cm.reverseIndex[reverseIndexKey{code: targetCode, system: targetSystem, conceptMapID: cm.id}] {
+		if sourceSystem != "" && m.sourceSystem != sourceSystem {
+			continue
+		}
+		matchedGroups[m.groupIdx] = true
+		out = append(out, HarmonizedCode{
+			Code:    m.sourceCode,
+			System:  m.sourceSystem,
+			Version: cm.version,
+		})
+	}
+
+	// Any candidate group (one whose target/source system matches the
+	// request) that contributed no match above still gets a chance to supply
+	// its unmapped fallback, same as the forward direction.
+	for gi, g := range cm.groups {
+		if matchedGroups[gi] {
+			continue
+		}
+		groupTarget := g.target
+		if groupTarget == "" {
+			groupTarget = cm.id
+		}
+		if groupTarget != targetSystem {
+			continue
+		}
+		groupSource := g.source
+		if groupSource == "" {
+			groupSource = cm.id
+		}
+		if sourceSystem != "" && groupSource != sourceSystem {
+			continue
+		}
+		if g.unmapped != nil {
+			out = append(out, reverseUnmappedHarmonizedCode(g, targetCode, groupSource, cm.version))
+		}
+	}
+
+	if len(out) == 0 {
+		out = append(out, HarmonizedCode{
+			Code:    targetCode,
+			System:  sourceName + "-unharmonized",
+			Version: cm.version,
+		})
+	}
+	return out, nil
+}
+
+// reverseUnmappedHarmonizedCode builds the fallback HarmonizedCode for a
+// group whose unmapped mode fired on a reverse lookup: the source system
+// takes the place the target system held going forward.
+func reverseUnmappedHarmonizedCode(g conceptMapGroup, targetCode, groupSource, version string) HarmonizedCode {
+	switch g.unmapped.mode {
+	case unmappedModeProvided:
+		return HarmonizedCode{Code: targetCode, Display: targetCode, System: groupSource, Version: version}
+	case unmappedModeFixed:
+		return HarmonizedCode{Code: g.unmapped.code, Display: g.unmapped.display, System: groupSource, Version: version}
+	default:
+		return HarmonizedCode{Code: targetCode, System: groupSource, Version: version}
+	}
+}
+
+// r3ConceptMap mirrors the subset of the FHIR R3 ConceptMap resource that
+// harmonization cares about.
+type r3ConceptMap struct {
+	ResourceType string `json:"resourceType"`
+	ID           string `json:"id"`
+	Version      string `json:"version"`
+	Group        []struct {
+		Source  string `json:"source"`
+		Target  string `json:"target"`
+		Element []struct {
+			Code   string `json:"code"`
+			Target []struct {
+				Code        string `json:"code"`
+				Display     string `json:"display"`
+				Equivalence string `json:"equivalence"`
+			} `json:"target"`
+		} `json:"element"`
+		Unmapped *struct {
+			Mode    string `json:"mode"`
+			Code    string `json:"code"`
+			Display string `json:"display"`
+		} `json:"unmapped"`
+	} `json:"group"`
+}
+
+// unmarshalR3ConceptMap parses a FHIR R3 ConceptMap resource into the
+// internal conceptMap representation.
+func unmarshalR3ConceptMap(raw json.RawMessage) (*conceptMap, error) {
+	var r r3ConceptMap
+	if err := json.Unmarshal(raw, &r); err != nil {
+		return nil, fmt.Errorf("invalid ConceptMap JSON: %v", err)
+	}
+	if r.ResourceType != "ConceptMap" {
+		return nil, fmt.Errorf("expected resourceType ConceptMap, got %q", r.ResourceType)
+	}
+	if r.ID == "" {
+		return nil, fmt.Errorf("ConceptMap is missing an id")
+	}
+	if len(r.Group) == 0 {
+		return nil, fmt.Errorf("ConceptMap %q has no group entries", r.ID)
+	}
+
+	cm := &conceptMap{id: r.ID, version: r.Version}
+	for _, g := range r.Group {
+		group := conceptMapGroup{source: g.Source, target: g.Target}
+		for _, e := range g.Element {
+			el := conceptMapElement{code: e.Code}
+			for _, t := range e.Target {
+				el.targets = append(el.targets, conceptMapTarget{
+					code:        t.Code,
+					display:     t.Display,
+					equivalence: t.Equivalence,
+				})
+			}
+			group.elements = append(group.elements, el)
+		}
+		if g.Unmapped != nil {
+			if g.Unmapped.Mode != "" && g.Unmapped.Mode != unmappedModeProvided && g.Unmapped.Mode != unmappedModeFixed {
+				return nil, fmt.Errorf("ConceptMap %q has unsupported unmapped mode %q", r.ID, g.Unmapped.Mode)
+			}
+			group.unmapped = &conceptMapUnmapped{
+				mode:    g.Unmapped.Mode,
+				code:    g.Unmapped.Code,
+				display: g.Unmapped.Display,
+			}
+		}
+		cm.groups = append(cm.groups, group)
+	}
+	return cm, nil
+}
+
+// r4ConceptMap mirrors the subset of the FHIR R4 ConceptMap resource that
+// harmonization cares about. Per-group source/target are now sourceUri or
+// sourceCanonical (and the target equivalents) rather than the plain strings
+// R3 used; element.target.equivalence is unchanged.
+type r4ConceptMap struct {
+	ResourceType string `json:"resourceType"`
+	ID           string `json:"id"`
+	Version      string `json:"version"`
+	Group        []struct {
+		SourceUri       string `json:"sourceUri"`
+		SourceCanonical string `json:"sourceCanonical"`
+		TargetUri       string `json:"targetUri"`
+		TargetCanonical string `json:"targetCanonical"`
+		Element         []struct {
+			Code   string `json:"code"`
+			Target []struct {
+				Code        string `json:"code"`
+				Display     string `json:"display"`
+				Equivalence string `json:"equivalence"`
+			} `json:"target"`
+		} `json:"element"`
+		Unmapped *struct {
+			Mode    string `json:"mode"`
+			Code    string `json:"code"`
+			Display string `json:"display"`
+		} `json:"unmapped"`
+	} `json:"group"`
+}
+
+// unmarshalR4ConceptMap parses a FHIR R4 ConceptMap resource into the
+// internal conceptMap representation.
+func unmarshalR4ConceptMap(raw json.RawMessage) (*conceptMap, error) {
+	var r r4ConceptMap
+	if err := json.Unmarshal(raw, &r); err != nil {
+		return nil, fmt.Errorf("invalid ConceptMap JSON: %v", err)
+	}
+	if r.ResourceType != "ConceptMap" {
+		return nil, fmt.Errorf("expected resourceType ConceptMap, got %q", r.ResourceType)
+	}
+	if r.ID == "" {
+		return nil, fmt.Errorf("ConceptMap is missing an id")
+	}
+	if len(r.Group) == 0 {
+		return nil, fmt.Errorf("ConceptMap %q has no group entries", r.ID)
+	}
+
+	cm := &conceptMap{id: r.ID, version: r.Version}
+	for _, g := range r.Group {
+		source := g.SourceUri
+		if source == "" {
+			source = g.SourceCanonical
+		}
+		target := g.TargetUri
+		if target == "" {
+			target = g.TargetCanonical
+		}
+		group := conceptMapGroup{source: source, target: target}
+		for _, e := range g.Element {
+			el := conceptMapElement{code: e.Code}
+			for _, t := range e.Target {
+				el.targets = append(el.targets, conceptMapTarget{
+					code:        t.Code,
+					display:     t.Display,
+					equivalence: t.Equivalence,
+				})
+			}
+			group.elements = append(group.elements, el)
+		}
+		if g.Unmapped != nil {
+			if g.Unmapped.Mode != "" && g.Unmapped.Mode != unmappedModeProvided && g.Unmapped.Mode != unmappedModeFixed {
+				return nil, fmt.Errorf("ConceptMap %q has unsupported unmapped mode %q", r.ID, g.Unmapped.Mode)
+			}
+			group.unmapped = &conceptMapUnmapped{
+				mode:    g.Unmapped.Mode,
+				code:    g.Unmapped.Code,
+				display: g.Unmapped.Display,
+			}
+		}
+		cm.groups = append(cm.groups, group)
+	}
+	return cm, nil
+}
+
+// r5RelationshipToEquivalence maps the FHIR R5 ConceptMapRelationship value
+// set onto the (STU3/R4-shaped) equivalence vocabulary the rest of this
+// package uses internally, so that downstream code does not need to special
+// case R5 maps.
+var r5RelationshipToEquivalence = map[string]string{
+	"related-to":                     EquivalenceRelatedTo,
+	"equivalent":                     EquivalenceEquivalent,
+	"source-is-narrower-than-target": EquivalenceNarrower,
+	"source-is-broader-than-target":  EquivalenceWider,
+	"not-related-to":                 EquivalenceDisjoint,
+}
+
+// r5ConceptMap mirrors the subset of the FHIR R5 ConceptMap resource that
+// harmonization cares about. Groups use the same sourceUri/sourceCanonical
+// shape R4 introduced, but element.target.equivalence was renamed to
+// element.target.relationship with a different value set.
+type r5ConceptMap struct {
+	ResourceType string `json:"resourceType"`
+	ID           string `json:"id"`
+	Version      string `json:"version"`
+	Group        []struct {
+		SourceUri       string `json:"sourceUri"`
+		SourceCanonical string `json:"sourceCanonical"`
+		TargetUri       string `json:"targetUri"`
+		TargetCanonical string `json:"targetCanonical"`
+		Element         []struct {
+			Code   string `json:"code"`
+			Target []struct {
+				Code         string `json:"code"`
+				Display      string `json:"display"`
+				Relationship string `json:"relationship"`
+			} `json:"target"`
+		} `json:"element"`
+		Unmapped *struct {
+			Mode    string `json:"mode"`
+			Code    string `json:"code"`
+			Display string `json:"display"`
+		} `json:"unmapped"`
+	} `json:"group"`
+}
+
+// unmarshalR5ConceptMap parses a FHIR R5 ConceptMap resource into the
+// internal conceptMap representation.
+func unmarshalR5ConceptMap(raw json.RawMessage) (*conceptMap, error) {
+	var r r5ConceptMap
+	if err := json.Unmarshal(raw, &r); err != nil {
+		return nil, fmt.Errorf("invalid ConceptMap JSON: %v", err)
+	}
+	if r.ResourceType != "ConceptMap" {
+		return nil, fmt.Errorf("expected resourceType ConceptMap, got %q", r.ResourceType)
+	}
+	if r.ID == "" {
+		return nil, fmt.Errorf("ConceptMap is missing an id")
+	}
+	if len(r.Group) == 0 {
+		return nil, fmt.Errorf("ConceptMap %q has no group entries", r.ID)
+	}
+
+	cm := &conceptMap{id: r.ID, version: r.Version}
+	for _, g := range r.Group {
+		source := g.SourceUri
+		if source == "" {
+			source = g.SourceCanonical
+		}
+		target := g.TargetUri
+		if target == "" {
+			target = g.TargetCanonical
+		}
+		group := conceptMapGroup{source: source, target: target}
+		for _, e := range g.Element {
+			el := conceptMapElement{code: e.Code}
+			for _, t := range e.Target {
+				equivalence, ok := r5RelationshipToEquivalence[t.Relationship]
+				if !ok {
+					return nil, fmt.Errorf("ConceptMap %q has unsupported relationship %q", r.ID, t.Relationship)
+				}
+				el.targets = append(el.targets, conceptMapTarget{
+					code:        t.Code,
+					display:     t.Display,
+					equivalence: equivalence,
+				})
+			}
+			group.elements = append(group.elements, el)
+		}
+		if g.Unmapped != nil {
+			if g.Unmapped.Mode != "" && g.Unmapped.Mode != unmappedModeProvided && g.Unmapped.Mode != unmappedModeFixed {
+				return nil, fmt.Errorf("ConceptMap %q has unsupported unmapped mode %q", r.ID, g.Unmapped.Mode)
+			}
+			group.unmapped = &conceptMapUnmapped{
+				mode:    g.Unmapped.Mode,
+				code:    g.Unmapped.Code,
+				display: g.Unmapped.Display,
+			}
+		}
+		cm.groups = append(cm.groups, group)
+	}
+	return cm, nil
+}
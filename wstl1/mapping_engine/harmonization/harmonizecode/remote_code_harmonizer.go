@@ -0,0 +1,450 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harmonizecode
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authenticator attaches credentials to an outgoing $translate request.
+type Authenticator interface {
+	Authenticate(req *http.Request) error
+}
+
+// BearerTokenAuthenticator attaches a static bearer token to every request.
+type BearerTokenAuthenticator struct {
+	Token string
+}
+
+// Authenticate implements Authenticator.
+func (a BearerTokenAuthenticator) Authenticate(req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+a.Token)
+	return nil
+}
+
+// TokenSource returns a bearer token on demand, e.g. one backed by Google
+// Cloud Application Default Credentials.
+type TokenSource interface {
+	Token() (string, error)
+}
+
+// ADCAuthenticator attaches a bearer token freshly pulled from a TokenSource
+// to every request, so that credentials can be refreshed independently of
+// the RemoteCodeHarmonizer's lifetime.
+type ADCAuthenticator struct {
+	Source TokenSource
+}
+
+// Authenticate implements Authenticator.
+func (a ADCAuthenticator) Authenticate(req *http.Request) error {
+	token, err := a.Source.Token()
+	if err != nil {
+		return fmt.Errorf("fetching ADC token: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// TranslateError reports a non-2xx response from a FHIR $translate request.
+type TranslateError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *TranslateError) Error() string {
+	return fmt.Sprintf("FHIR $translate request failed with status %d: %s", e.StatusCode, e.Body)
+}
+
+// translateEquivalenceHasConcept reports whether a $translate match with the
+// given equivalence value carries a usable target concept. "unmatched" and
+// "disjoint" matches describe the absence of a mapping, so they contribute
+// nothing to the result.
+func translateEquivalenceHasConcept(equivalence string) bool {
+	return equivalence != "unmatched" && equivalence != "disjoint"
+}
+
+// translateEquivalenceToCanonical maps the FHIR ConceptMapEquivalence codes
+// used by $translate's match.equivalence onto this package's canonical
+// Equivalence* vocabulary.
+var translateEquivalenceToCanonical = map[string]string{
+	"relatedto":   EquivalenceRelatedTo,
+	"equivalent":  EquivalenceEquivalent,
+	"equal":       EquivalenceEqual,
+	"wider":       EquivalenceWider,
+	"subsumes":    EquivalenceSubsumes,
+	"narrower":    EquivalenceNarrower,
+	"specializes": EquivalenceSpecializes,
+	"inexact":     EquivalenceInexact,
+	"unmatched":   EquivalenceUnmatched,
+	"disjoint":    EquivalenceDisjoint,
+}
+
+// inflightTranslate is a $translate call in progress, shared by every
+// concurrent lookup for the same key so that a cache miss does not fan out
+// into duplicate HTTP requests.
+type inflightTranslate struct {
+	wg     sync.WaitGroup
+	result []HarmonizedCode
+	err    error
+}
+
+// RemoteCodeHarmonizer is a CodeHarmonizer that resolves codes against a FHIR
+// terminology server's ConceptMap/$translate operation over HTTP, caching
+// results and coalescing concurrent lookups for the same code.
+type RemoteCodeHarmonizer struct {
+	baseURL    string
+	httpClient *http.Client
+	auth       Authenticator
+	retries    int
+	retryDelay time.Duration
+
+	cache *ExpiringCache
+
+	inflightMu sync.Mutex
+	inflight   map[CodeLookupKey]*inflightTranslate
+}
+
+// RemoteCodeHarmonizerOption configures a RemoteCodeHarmonizer constructed
+// by NewRemoteCodeHarmonizer.
+type RemoteCodeHarmonizerOption func(*RemoteCodeHarmonizer)
+
+// WithAuthenticator attaches auth credentials to every $translate request.
+func WithAuthenticator(auth Authenticator) RemoteCodeHarmonizerOption {
+	return func(r *RemoteCodeHarmonizer) { r.auth = auth }
+}
+
+// WithHTTPClient overrides the http.Client used to issue $translate
+// requests.
+func WithHTTPClient(client *http.Client) RemoteCodeHarmonizerOption {
+	return func(r *RemoteCodeHarmonizer) { r.httpClient = client }
+}
+
+// WithTimeout sets how long a single $translate request may take before it
+// is considered failed and, if retries remain, retried.
+func WithTimeout(timeout time.Duration) RemoteCodeHarmonizerOption {
+	return func(r *RemoteCodeHarmonizer) { r.httpClient.Timeout = timeout }
+}
+
+// WithRetries sets how many additional attempts a $translate request gets
+// after a network error or 5xx response, waiting delay between attempts. 4xx
+// responses are never retried.
+func WithRetries(retries int, delay time.Duration) RemoteCodeHarmonizerOption {
+	return func(r *RemoteCodeHarmonizer) {
+		r.retries = retries
+		r.retryDelay = delay
+	}
+}
+
+// WithResultCache overrides the ExpiringCache used to memoize $translate
+// results.
+func WithResultCache(cache *ExpiringCache) RemoteCodeHarmonizerOption {
+	return func(r *RemoteCodeHarmonizer) { r.cache = cache }
+}
+
+// NewRemoteCodeHarmonizer creates a RemoteCodeHarmonizer that issues
+// $translate requests against baseURL, a FHIR terminology server's base
+// endpoint (e.g. "https://healthcare.googleapis.com/v1/.../fhir").
+func NewRemoteCodeHarmonizer(baseURL string, opts ...RemoteCodeHarmonizerOption) *RemoteCodeHarmonizer {
+	r := &RemoteCodeHarmonizer{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		cache:      NewCache(300, 60),
+		inflight:   make(map[CodeLookupKey]*inflightTranslate),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Harmonize implements CodeHarmonizer.
+func (r *RemoteCodeHarmonizer) Harmonize(sourceCode, sourceSystem, sourceName string) ([]HarmonizedCode, error) {
+	return r.HarmonizeWithTarget(sourceCode, sourceSystem, "", sourceName)
+}
+
+// HarmonizeWithTarget implements CodeHarmonizer.
+func (r *RemoteCodeHarmonizer) HarmonizeWithTarget(sourceCode, sourceSystem, targetSystem, sourceName string) ([]HarmonizedCode, error) {
+	codes, err := r.lookup(sourceCode, sourceSystem, targetSystem, sourceName)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]HarmonizedCode, len(codes))
+	for i, c := range codes {
+		c.Equivalence = ""
+		out[i] = c
+	}
+	return out, nil
+}
+
+// HarmonizeWithOptions implements CodeHarmonizer.
+func (r *RemoteCodeHarmonizer) HarmonizeWithOptions(sourceCode, sourceSystem, targetSystem, sourceName string, opts HarmonizeOptions) ([]HarmonizedCode, error) {
+	codes, err := r.lookup(sourceCode, sourceSystem, targetSystem, sourceName)
+	if err != nil {
+		return nil, err
+	}
+	return applyHarmonizeOptions(codes, opts), nil
+}
+
+// HarmonizeReverse implements CodeHarmonizer.
+func (r *RemoteCodeHarmonizer) HarmonizeReverse(targetCode, targetSystem, sourceName string) ([]HarmonizedCode, error) {
+	return r.HarmonizeReverseWithSource(targetCode, targetSystem, "", sourceName)
+}
+
+// HarmonizeReverseWithSource implements CodeHarmonizer.
+func (r *RemoteCodeHarmonizer) HarmonizeReverseWithSource(targetCode, targetSystem, sourceSystem, sourceName string) ([]HarmonizedCode, error) {
+	codes, err := r.lookupReverse(targetCode, targetSystem, sourceSystem, sourceName)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]HarmonizedCode, len(codes))
+	for i, c := range codes {
+		c.Equivalence = ""
+		out[i] = c
+	}
+	return out, nil
+}
+
+// lookup resolves sourceCode via $translate, same as HarmonizeWithTarget, but
+// also populates Equivalence on every returned HarmonizedCode. Results are
+// cached and concurrent lookups for the same key are coalesced into a single
+// HTTP call.
+func (r *RemoteCodeHarmonizer) lookup(sourceCode, sourceSystem, targetSystem, sourceName string) ([]HarmonizedCode, error) {
+	key := remoteCodeLookupKey(sourceCode, sourceSystem, targetSystem, sourceName)
+	return r.resolve(key, func() ([]HarmonizedCode, error) {
+		return r.translate(sourceCode, sourceSystem, targetSystem, sourceName)
+	})
+}
+
+// lookupReverse resolves targetCode back to its source code(s) via
+// $translate's reverse=true mode, with the same caching and coalescing as
+// lookup.
+func (r *RemoteCodeHarmonizer) lookupReverse(targetCode, targetSystem, sourceSystem, sourceName string) ([]HarmonizedCode, error) {
+	key := remoteReverseCodeLookupKey(targetCode, targetSystem, sourceSystem, sourceName)
+	return r.resolve(key, func() ([]HarmonizedCode, error) {
+		return r.translateReverse(targetCode, targetSystem, sourceSystem, sourceName)
+	})
+}
+
+// resolve returns the cached result for key if present, otherwise calls
+// fetch, coalescing concurrent calls for the same key into a single fetch.
+func (r *RemoteCodeHarmonizer) resolve(key CodeLookupKey, fetch func() ([]HarmonizedCode, error)) ([]HarmonizedCode, error) {
+	if cached, ok := r.cache.Get(key); ok {
+		return cached, nil
+	}
+
+	r.inflightMu.Lock()
+	if call, ok := r.inflight[key]; ok {
+		r.inflightMu.Unlock()
+		call.wg.Wait()
+		return call.result, call.err
+	}
+	call := &inflightTranslate{}
+	call.wg.Add(1)
+	r.inflight[key] = call
+	r.inflightMu.Unlock()
+
+	result, err := fetch()
+	call.result, call.err = result, err
+
+	// Populate the cache before dropping the inflight entry: a concurrent
+	// resolve for the same key that arrives between the delete and the Put
+	// would otherwise see neither an inflight call to wait on nor a cache
+	// entry to reuse, and would fan out a duplicate fetch.
+	if err == nil {
+		r.cache.Put(key, result)
+	}
+
+	r.inflightMu.Lock()
+	delete(r.inflight, key)
+	r.inflightMu.Unlock()
+	call.wg.Done()
+
+	return result, err
+}
+
+// remoteCodeLookupKey builds the cache/coalescing key for a forward lookup.
+// An empty targetSystem collapses to the same key Harmonize would use, so
+// Harmonize and HarmonizeWithTarget("", ...) share cache entries.
+func remoteCodeLookupKey(sourceCode, sourceSystem, targetSystem, sourceName string) CodeLookupKey {
+	conceptMapID := sourceName
+	if targetSystem != "" {
+		conceptMapID = sourceName + "::" + targetSystem
+	}
+	return CodeLookupKey{Code: sourceCode, System: sourceSystem, ConceptMapID: conceptMapID}
+}
+
+// remoteReverseCodeLookupKey builds the cache/coalescing key for a reverse
+// lookup. It is namespaced with "::reverse" so it can never collide with a
+// forward lookup's key.
+func remoteReverseCodeLookupKey(targetCode, targetSystem, sourceSystem, sourceName string) CodeLookupKey {
+	conceptMapID := sourceName + "::reverse"
+	if sourceSystem != "" {
+		conceptMapID += "::" + sourceSystem
+	}
+	return CodeLookupKey{Code: targetCode, System: targetSystem, ConceptMapID: conceptMapID}
+}
+
+// translate issues a forward $translate HTTP request, retrying on network
+// errors and 5xx responses.
+func (r *RemoteCodeHarmonizer) translate(sourceCode, sourceSystem, targetSystem, sourceName string) ([]HarmonizedCode, error) {
+	q := url.Values{}
+	q.Set("url", sourceName)
+	q.Set("system", sourceSystem)
+	q.Set("code", sourceCode)
+	if targetSystem != "" {
+		q.Set("targetsystem", targetSystem)
+	}
+	endpoint := r.baseURL + "/ConceptMap/$translate?" + q.Encode()
+	return r.doTranslateWithRetries(endpoint)
+}
+
+// translateReverse issues a reverse $translate HTTP request (reverse=true),
+// retrying on network errors and 5xx responses.
+func (r *RemoteCodeHarmonizer) translateReverse(targetCode, targetSystem, sourceSystem, sourceName string) ([]HarmonizedCode, error) {
+	q := url.Values{}
+	q.Set("url", sourceName)
+	q.Set("system", targetSystem)
+	q.Set("code", targetCode)
+	q.Set("reverse", "true")
+	if sourceSystem != "" {
+		q.Set("target", sourceSystem)
+	}
+	endpoint := r.baseURL + "/ConceptMap/$translate?" + q.Encode()
+	return r.doTranslateWithRetries(endpoint)
+}
+
+// doTranslateWithRetries retries doTranslate per r.retries/r.retryDelay.
+func (r *RemoteCodeHarmonizer) doTranslateWithRetries(endpoint string) ([]HarmonizedCode, error) {
+	var lastErr error
+	for attempt := 0; attempt <= r.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(r.retryDelay)
+		}
+		result, retryable, err := r.doTranslate(endpoint)
+		if err == nil {
+			return result, nil
+		}
+		lastErr = err
+		if !retryable {
+			return nil, err
+		}
+	}
+	return nil, lastErr
+}
+
+// doTranslate performs a single $translate HTTP round trip. The returned
+// bool reports whether the error, if any, is worth retrying.
+func (r *RemoteCodeHarmonizer) doTranslate(endpoint string) ([]HarmonizedCode, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("building $translate request: %v", err)
+	}
+	if r.auth != nil {
+		if err := r.auth.Authenticate(req); err != nil {
+			return nil, false, fmt.Errorf("authenticating $translate request: %v", err)
+		}
+	}
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, true, fmt.Errorf("sending $translate request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, fmt.Errorf("reading $translate response: %v", err)
+	}
+
+	if resp.StatusCode >= 500 {
+		return nil, true, &TranslateError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	if resp.StatusCode >= 400 {
+		return nil, false, &TranslateError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	codes, err := parseTranslateResponse(body)
+	if err != nil {
+		return nil, false, err
+	}
+	return codes, false, nil
+}
+
+// translateParameters mirrors the subset of the FHIR Parameters resource
+// returned by ConceptMap/$translate that harmonization cares about.
+type translateParameters struct {
+	ResourceType string `json:"resourceType"`
+	Parameter    []struct {
+		Name string `json:"name"`
+		Part []struct {
+			Name        string `json:"name"`
+			ValueCode   string `json:"valueCode"`
+			ValueCoding *struct {
+				System  string `json:"system"`
+				Code    string `json:"code"`
+				Display string `json:"display"`
+			} `json:"valueCoding"`
+		} `json:"part"`
+	} `json:"parameter"`
+}
+
+// parseTranslateResponse extracts a HarmonizedCode per "match" parameter
+// that carries a concept, per the $translate response shape:
+//
+//	{"name": "match", "part": [
+//	  {"name": "equivalence", "valueCode": "equivalent"},
+//	  {"name": "concept", "valueCoding": {"system": ..., "code": ..., "display": ...}}
+//	]}
+func parseTranslateResponse(body []byte) ([]HarmonizedCode, error) {
+	var p translateParameters
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, fmt.Errorf("invalid $translate Parameters response: %v", err)
+	}
+
+	var out []HarmonizedCode
+	for _, param := range p.Parameter {
+		if param.Name != "match" {
+			continue
+		}
+		var equivalence string
+		var concept *HarmonizedCode
+		for _, part := range param.Part {
+			switch part.Name {
+			case "equivalence":
+				equivalence = part.ValueCode
+			case "concept":
+				if part.ValueCoding != nil {
+					concept = &HarmonizedCode{
+						Code:    part.ValueCoding.Code,
+						System:  part.ValueCoding.System,
+						Display: part.ValueCoding.Display,
+					}
+				}
+			}
+		}
+		if concept != nil && translateEquivalenceHasConcept(equivalence) {
+			concept.Equivalence = translateEquivalenceToCanonical[equivalence]
+			out = append(out, *concept)
+		}
+	}
+	return out, nil
+}
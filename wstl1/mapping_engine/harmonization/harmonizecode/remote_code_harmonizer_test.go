@@ -0,0 +1,321 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harmonizecode
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
+)
+
+const translateResponseBody = `{
+	"resourceType": "Parameters",
+	"parameter": [
+		{"name": "result", "valueBoolean": true},
+		{"name": "match", "part": [
+			{"name": "equivalence", "valueCode": "equivalent"},
+			{"name": "concept", "valueCoding": {"system": "xyz", "code": "def", "display": "DEF"}}
+		]}
+	]
+}`
+
+func TestRemoteCodeHarmonizer_HitAndMiss(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "application/fhir+json")
+		w.Write([]byte(translateResponseBody))
+	}))
+	defer server.Close()
+
+	harmonizer := NewRemoteCodeHarmonizer(server.URL)
+
+	want := []HarmonizedCode{{Code: "def", System: "xyz", Display: "DEF"}}
+
+	got, err := harmonizer.Harmonize("abc", "foo", "map-id")
+	if err != nil {
+		t.Fatalf("Harmonize returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Harmonize() => diff (-want +got)\n%s", diff)
+	}
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Fatalf("expected 1 HTTP call on miss, got %d", calls)
+	}
+
+	got, err = harmonizer.Harmonize("abc", "foo", "map-id")
+	if err != nil {
+		t.Fatalf("Harmonize returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Harmonize() => diff (-want +got)\n%s", diff)
+	}
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Fatalf("expected cache hit to avoid a second HTTP call, got %d calls", calls)
+	}
+}
+
+func TestRemoteCodeHarmonizer_TTLExpiry(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte(translateResponseBody))
+	}))
+	defer server.Close()
+
+	harmonizer := NewRemoteCodeHarmonizer(server.URL, WithResultCache(NewCache(1, 1)))
+
+	if _, err := harmonizer.Harmonize("abc", "foo", "map-id"); err != nil {
+		t.Fatalf("Harmonize returned unexpected error: %v", err)
+	}
+	time.Sleep(3 * time.Second)
+	if _, err := harmonizer.Harmonize("abc", "foo", "map-id"); err != nil {
+		t.Fatalf("Harmonize returned unexpected error: %v", err)
+	}
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Fatalf("expected TTL expiry to force a second HTTP call, got %d calls", calls)
+	}
+}
+
+func TestRemoteCodeHarmonizer_CoalescesConcurrentMisses(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		w.Write([]byte(translateResponseBody))
+	}))
+	defer server.Close()
+
+	harmonizer := NewRemoteCodeHarmonizer(server.URL)
+
+	const n = 10
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			if _, err := harmonizer.Harmonize("abc", "foo", "map-id"); err != nil {
+				t.Errorf("Harmonize returned unexpected error: %v", err)
+			}
+		}()
+	}
+
+	// Give every goroutine a chance to reach the in-flight call before
+	// unblocking the single HTTP handler invocation they should share.
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("expected concurrent lookups for the same key to coalesce into 1 HTTP call, got %d", got)
+	}
+}
+
+func TestRemoteCodeHarmonizer_ParsesMultipleMatches(t *testing.T) {
+	const body = `{
+		"resourceType": "Parameters",
+		"parameter": [
+			{"name": "match", "part": [
+				{"name": "equivalence", "valueCode": "equivalent"},
+				{"name": "concept", "valueCoding": {"system": "xyz1", "code": "def1"}}
+			]},
+			{"name": "match", "part": [
+				{"name": "equivalence", "valueCode": "wider"},
+				{"name": "concept", "valueCoding": {"system": "xyz2", "code": "def2"}}
+			]},
+			{"name": "match", "part": [
+				{"name": "equivalence", "valueCode": "unmatched"}
+			]}
+		]
+	}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	harmonizer := NewRemoteCodeHarmonizer(server.URL)
+	got, err := harmonizer.Harmonize("abc", "foo", "map-id")
+	if err != nil {
+		t.Fatalf("Harmonize returned unexpected error: %v", err)
+	}
+	want := []HarmonizedCode{
+		{Code: "def1", System: "xyz1"},
+		{Code: "def2", System: "xyz2"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Harmonize() => diff (-want +got)\n%s", diff)
+	}
+}
+
+func TestRemoteCodeHarmonizer_ErrorPropagation(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+	}{
+		{"bad request", http.StatusBadRequest},
+		{"not found", http.StatusNotFound},
+		{"server error", http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(test.statusCode)
+				w.Write([]byte(`{"resourceType":"OperationOutcome"}`))
+			}))
+			defer server.Close()
+
+			harmonizer := NewRemoteCodeHarmonizer(server.URL, WithRetries(1, time.Millisecond))
+			_, err := harmonizer.Harmonize("abc", "foo", "map-id")
+			if err == nil {
+				t.Fatalf("Harmonize expected an error for status %d but got none", test.statusCode)
+			}
+			translateErr, ok := err.(*TranslateError)
+			if !ok {
+				t.Fatalf("Harmonize returned error of type %T, want *TranslateError", err)
+			}
+			if translateErr.StatusCode != test.statusCode {
+				t.Errorf("TranslateError.StatusCode = %d, want %d", translateErr.StatusCode, test.statusCode)
+			}
+		})
+	}
+}
+
+func TestRemoteCodeHarmonizer_RetriesServerErrors(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(translateResponseBody))
+	}))
+	defer server.Close()
+
+	harmonizer := NewRemoteCodeHarmonizer(server.URL, WithRetries(2, time.Millisecond))
+	got, err := harmonizer.Harmonize("abc", "foo", "map-id")
+	if err != nil {
+		t.Fatalf("Harmonize returned unexpected error after retries: %v", err)
+	}
+	want := []HarmonizedCode{{Code: "def", System: "xyz", Display: "DEF"}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Harmonize() => diff (-want +got)\n%s", diff)
+	}
+	if got := atomic.LoadInt32(&calls); got != 3 {
+		t.Errorf("expected 3 attempts (1 + 2 retries), got %d", got)
+	}
+}
+
+func TestRemoteCodeHarmonizer_DoesNotRetryClientErrors(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	harmonizer := NewRemoteCodeHarmonizer(server.URL, WithRetries(2, time.Millisecond))
+	if _, err := harmonizer.Harmonize("abc", "foo", "map-id"); err == nil {
+		t.Fatalf("Harmonize expected an error but got none")
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("expected 4xx to fail fast with 1 attempt, got %d", got)
+	}
+}
+
+func TestRemoteCodeHarmonizer_HarmonizeReverse(t *testing.T) {
+	var gotQuery string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotQuery = req.URL.RawQuery
+		w.Write([]byte(translateResponseBody))
+	}))
+	defer server.Close()
+
+	harmonizer := NewRemoteCodeHarmonizer(server.URL)
+	got, err := harmonizer.HarmonizeReverse("def", "xyz", "map-id")
+	if err != nil {
+		t.Fatalf("HarmonizeReverse returned unexpected error: %v", err)
+	}
+	want := []HarmonizedCode{{Code: "def", System: "xyz", Display: "DEF"}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("HarmonizeReverse() => diff (-want +got)\n%s", diff)
+	}
+	if !strings.Contains(gotQuery, "reverse=true") {
+		t.Errorf("HarmonizeReverse query = %q, want it to contain reverse=true", gotQuery)
+	}
+}
+
+func TestRemoteCodeHarmonizer_HarmonizeReverseCaches(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte(translateResponseBody))
+	}))
+	defer server.Close()
+
+	harmonizer := NewRemoteCodeHarmonizer(server.URL)
+	if _, err := harmonizer.HarmonizeReverse("def", "xyz", "map-id"); err != nil {
+		t.Fatalf("HarmonizeReverse returned unexpected error: %v", err)
+	}
+	if _, err := harmonizer.HarmonizeReverse("def", "xyz", "map-id"); err != nil {
+		t.Fatalf("HarmonizeReverse returned unexpected error: %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("expected cache hit to avoid a second HTTP call, got %d calls", got)
+	}
+}
+
+type staticTokenSource struct {
+	token string
+}
+
+func (s staticTokenSource) Token() (string, error) {
+	return s.token, nil
+}
+
+func TestRemoteCodeHarmonizer_AuthenticatorsSetAuthHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		auth Authenticator
+		want string
+	}{
+		{"bearer token", BearerTokenAuthenticator{Token: "abc123"}, "Bearer abc123"},
+		{"adc token source", ADCAuthenticator{Source: staticTokenSource{token: "adc-token"}}, "Bearer adc-token"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var gotHeader string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				gotHeader = req.Header.Get("Authorization")
+				w.Write([]byte(translateResponseBody))
+			}))
+			defer server.Close()
+
+			harmonizer := NewRemoteCodeHarmonizer(server.URL, WithAuthenticator(test.auth))
+			if _, err := harmonizer.Harmonize("abc", "foo", "map-id"); err != nil {
+				t.Fatalf("Harmonize returned unexpected error: %v", err)
+			}
+			if gotHeader != test.want {
+				t.Errorf("Authorization header = %q, want %q", gotHeader, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,374 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harmonizecode
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
+)
+
+func TestHarmonizeReverseWithSource(t *testing.T) {
+	testConceptMap1 := json.RawMessage(`{
+				"group":[
+					{
+						"element":[
+							{
+								"code": "abc",
+								"target":[
+									{
+										"code": "def1",
+										"equivalence": "EQUIVALENT"
+									}
+								]
+							}
+						],
+						"source": "s1",
+						"target": "t1"
+					},
+					{
+						"element":[
+							{
+								"code": "abc",
+								"target":[
+									{
+										"code": "def2",
+										"equivalence": "EQUIVALENT"
+									}
+								]
+							}
+						],
+						"source": "s2",
+						"target": "t2"
+					}
+				],
+				"id": "foo",
+				"version": "bar",
+   			"resourceType":"ConceptMap"
+			}`)
+	tests := []struct {
+		name           string
+		rawConceptMap  json.RawMessage
+		targetCode     string
+		targetSystem   string
+		sourceSystem   string
+		sourceName     string
+		expectedOutput []HarmonizedCode
+	}{
+		{
+			name:          "match target and source systems 1",
+			rawConceptMap: testConceptMap1,
+			targetCode:    "def1",
+			targetSystem:  "t1",
+			sourceSystem:  "s1",
+			sourceName:    "foo",
+			expectedOutput: []HarmonizedCode{
+				HarmonizedCode{
+					Code:    "abc",
+					System:  "s1",
+					Version: "bar",
+				},
+			},
+		},
+		{
+			name:          "match target and source systems 2",
+			rawConceptMap: testConceptMap1,
+			targetCode:    "def2",
+			targetSystem:  "t2",
+			sourceSystem:  "s2",
+			sourceName:    "foo",
+			expectedOutput: []HarmonizedCode{
+				HarmonizedCode{
+					Code:    "abc",
+					System:  "s2",
+					Version: "bar",
+				},
+			},
+		},
+		{
+			name:          "match target and mismatch source",
+			rawConceptMap: testConceptMap1,
+			targetCode:    "def2",
+			targetSystem:  "t2",
+			sourceSystem:  "s1",
+			sourceName:    "foo",
+			expectedOutput: []HarmonizedCode{
+				HarmonizedCode{
+					Code:    "def2",
+					System:  "foo-unharmonized",
+					Version: "bar",
+				},
+			},
+		},
+		{
+			name:          "match target and empty source",
+			rawConceptMap: testConceptMap1,
+			targetCode:    "def2",
+			targetSystem:  "t2",
+			sourceSystem:  "",
+			sourceName:    "foo",
+			expectedOutput: []HarmonizedCode{
+				HarmonizedCode{
+					Code:    "abc",
+					System:  "s2",
+					Version: "bar",
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			harmonizer, err := buildTestLocalHarmonizer([]json.RawMessage{test.rawConceptMap})
+			if err != nil {
+				t.Fatalf("buildTestLocalHarmonizer returned unexpected error: %v", err)
+			}
+
+			actualOutput, err := harmonizer.HarmonizeReverseWithSource(test.targetCode, test.targetSystem, test.sourceSystem, test.sourceName)
+			if err != nil {
+				t.Fatalf("HarmonizeReverseWithSource(%s, %s, %s, %s) returned unexpected error: %v", test.targetCode, test.targetSystem, test.sourceSystem, test.sourceName, err)
+			}
+
+			if diff := cmp.Diff(test.expectedOutput, actualOutput); diff != "" {
+				t.Errorf("HarmonizeReverseWithSource(%s, %s, %s, %s) => diff -%v +%v\n%s", test.targetCode, test.targetSystem, test.sourceSystem, test.sourceName, test.expectedOutput, actualOutput, diff)
+			}
+		})
+	}
+}
+
+func TestHarmonizeRoundTrip_EmptyGroupTargetDefaultsToConceptMapID(t *testing.T) {
+	// A group with no "target" defaults its target system to the ConceptMap
+	// id on both the forward and reverse paths, so the System a forward
+	// Harmonize emits is exactly what a reverse HarmonizeReverse must be
+	// queried with to find the same mapping.
+	rawConceptMap := json.RawMessage(`{
+		"group":[
+			{
+				"element":[
+					{
+						"code": "abc",
+						"target":[{"code": "def", "equivalence": "EQUIVALENT"}]
+					}
+				],
+				"source": "s1"
+			}
+		],
+		"id": "map1",
+		"version": "bar",
+		"resourceType":"ConceptMap"
+	}`)
+	harmonizer, err := buildTestLocalHarmonizer([]json.RawMessage{rawConceptMap})
+	if err != nil {
+		t.Fatalf("buildTestLocalHarmonizer returned unexpected error: %v", err)
+	}
+
+	forward, err := harmonizer.Harmonize("abc", "s1", "map1")
+	if err != nil {
+		t.Fatalf("Harmonize returned unexpected error: %v", err)
+	}
+	wantForward := []HarmonizedCode{{Code: "def", System: "map1", Version: "bar"}}
+	if diff := cmp.Diff(wantForward, forward); diff != "" {
+		t.Errorf("Harmonize() => diff (-want +got)\n%s", diff)
+	}
+
+	reverse, err := harmonizer.HarmonizeReverse("def", forward[0].System, "map1")
+	if err != nil {
+		t.Fatalf("HarmonizeReverse returned unexpected error: %v", err)
+	}
+	wantReverse := []HarmonizedCode{{Code: "abc", System: "s1", Version: "bar"}}
+	if diff := cmp.Diff(wantReverse, reverse); diff != "" {
+		t.Errorf("HarmonizeReverse() => diff (-want +got)\n%s", diff)
+	}
+}
+
+func TestHarmonizeReverse(t *testing.T) {
+	tests := []struct {
+		name           string
+		rawConceptMap  json.RawMessage
+		targetCode     string
+		targetSystem   string
+		sourceName     string
+		expectedOutput []HarmonizedCode
+	}{
+		{
+			name: "single source code",
+			rawConceptMap: json.RawMessage(`{
+				"group":[
+					{
+						"element":[
+							{
+								"code":"abc",
+								"target":[
+									{
+										"code":"def",
+										"display": "DEF",
+										"equivalence": "EQUIVALENT"
+									}
+								]
+							}
+						],
+						"source": "foo",
+						"target": "xyz"
+					}
+				],
+				"id": "foo",
+				"version": "bar",
+   			"resourceType":"ConceptMap"
+			}`),
+			targetCode:   "def",
+			targetSystem: "xyz",
+			sourceName:   "foo",
+			expectedOutput: []HarmonizedCode{
+				HarmonizedCode{
+					Code:    "abc",
+					System:  "foo",
+					Version: "bar",
+				},
+			},
+		},
+		{
+			name: "no matches found",
+			rawConceptMap: json.RawMessage(`{
+				"group":[
+					{
+						"element":[
+							{
+								"code": "abc",
+								"target":[
+									{
+										"code": "def",
+										"equivalence": "EQUIVALENT"
+									}
+								]
+							}
+						],
+						"source": "foo",
+						"target": "xyz"
+					}
+				],
+				"id": "foo",
+				"version": "bar",
+				"resourceType": "ConceptMap"
+			}`),
+			targetCode:   "unmatched",
+			targetSystem: "xyz",
+			sourceName:   "foo",
+			expectedOutput: []HarmonizedCode{
+				HarmonizedCode{
+					Code:    "unmatched",
+					System:  "foo-unharmonized",
+					Version: "bar",
+				},
+			},
+		},
+		{
+			name: "no matches found with provided unmapped mode",
+			rawConceptMap: json.RawMessage(`{
+				"group":[
+					{
+						"element":[
+							{
+								"code": "abc",
+								"target":[
+									{
+										"code": "def",
+										"equivalence": "EQUIVALENT"
+									}
+								]
+							}
+						],
+						"unmapped": {
+							"mode": "provided"
+						},
+						"target": "xyz",
+						"source": "foo"
+					}
+				],
+				"id": "map-id",
+				"version": "bar",
+				"resourceType": "ConceptMap"
+			}`),
+			targetCode:   "unmatched",
+			targetSystem: "xyz",
+			sourceName:   "map-id",
+			expectedOutput: []HarmonizedCode{
+				HarmonizedCode{
+					Code:    "unmatched",
+					Display: "unmatched",
+					System:  "foo",
+					Version: "bar",
+				},
+			},
+		},
+		{
+			name: "no matches found with fixed unmapped mode",
+			rawConceptMap: json.RawMessage(`{
+				"group":[
+					{
+						"element":[
+							{
+								"code": "abc",
+								"target":[
+									{
+										"code": "def",
+										"equivalence": "EQUIVALENT"
+									}
+								]
+							}
+						],
+						"unmapped": {
+							"mode": "fixed",
+							"code": "unknown",
+							"display": "Unknown Code"
+						},
+						"target": "xyz",
+						"source": "foo"
+					}
+				],
+				"id": "map-id",
+				"version": "bar",
+				"resourceType": "ConceptMap"
+			}`),
+			targetCode:   "unmatched",
+			targetSystem: "xyz",
+			sourceName:   "map-id",
+			expectedOutput: []HarmonizedCode{
+				HarmonizedCode{
+					Code:    "unknown",
+					Display: "Unknown Code",
+					System:  "foo",
+					Version: "bar",
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			harmonizer, err := buildTestLocalHarmonizer([]json.RawMessage{test.rawConceptMap})
+			if err != nil {
+				t.Fatalf("buildTestLocalHarmonizer returned unexpected error: %v", err)
+			}
+
+			actualOutput, err := harmonizer.HarmonizeReverse(test.targetCode, test.targetSystem, test.sourceName)
+			if err != nil {
+				t.Fatalf("HarmonizeReverse(%s, %s, %s) returned unexpected error: %v", test.targetCode, test.targetSystem, test.sourceName, err)
+			}
+
+			if diff := cmp.Diff(test.expectedOutput, actualOutput); diff != "" {
+				t.Errorf("HarmonizeReverse(%s, %s, %s) => diff -%v +%v\n%s", test.targetCode, test.targetSystem, test.sourceName, test.expectedOutput, actualOutput, diff)
+			}
+		})
+	}
+}